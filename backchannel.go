@@ -0,0 +1,46 @@
+package yamux
+
+import "net"
+
+// BackchannelListener adapts a Session's backchannel streams to a
+// net.Listener, so the passive side of a connection can hand them to
+// something like grpc.Serve without the caller needing to know about
+// yamux directly.
+//
+// Client and server each get their own disjoint stream-ID bucket for
+// backchannel streams, separate from the buckets used for normal forward
+// streams: client forward IDs are 1 mod 4, server forward IDs are 2 mod
+// 4, server backchannel IDs are 3 mod 4, and client backchannel IDs are
+// 0 mod 4 (see newSession). A peer recognizes an incoming SYN as a
+// backchannel stream purely by which bucket its ID falls in, so forward
+// and reverse traffic can never collide. There is no separate
+// negotiation frame; both sides simply need to construct their Session
+// with Config.AllowBothSidesOpen set to true for this to work.
+type BackchannelListener struct {
+	session *Session
+}
+
+// Listener returns a net.Listener that Accepts only backchannel streams,
+// i.e. streams the peer opened back to us with OpenBackchannel. It is
+// only valid when the session was created with Config.AllowBothSidesOpen.
+func (s *Session) Listener() *BackchannelListener {
+	return &BackchannelListener{session: s}
+}
+
+// Accept blocks until the peer opens a backchannel stream.
+func (l *BackchannelListener) Accept() (net.Conn, error) {
+	return l.session.AcceptBackchannel()
+}
+
+// Close closes the underlying session.
+func (l *BackchannelListener) Close() error {
+	return l.session.Close()
+}
+
+// Addr returns the local address of the underlying connection.
+func (l *BackchannelListener) Addr() net.Addr {
+	if conn, ok := l.session.conn.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package yamux
+
+import "time"
+
+// Config is used to tune the Yamux session
+type Config struct {
+	// AcceptBacklog is used to limit how many streams may be
+	// waiting an accept.
+	AcceptBacklog int
+
+	// EnableKeepalive is used to do a period keep alive
+	// messages using a ping.
+	EnableKeepAlive bool
+
+	// KeepAliveInterval is how often to perform the keep alive
+	KeepAliveInterval time.Duration
+
+	// MaxStreamWindowSize is used to control the maximum
+	// window size that we allow for a stream.
+	MaxStreamWindowSize uint32
+
+	// AllowBothSidesOpen enables OpenBackchannel/AcceptBackchannel:
+	// streams opened with OpenBackchannel use an ID bucket of their own
+	// and are delivered to the peer's AcceptBackchannel instead of its
+	// Accept. Plain Open works on both sides either way. See
+	// backchannel.go.
+	AllowBothSidesOpen bool
+
+	// HandshakeTimeout bounds how long we wait to read the peer's first
+	// frame before giving up, so a connection that never writes
+	// anything can't park recv() in io.ReadFull forever. It is enforced
+	// with a read deadline, so it only applies when the conn is a
+	// net.Conn. Zero disables the timeout.
+	HandshakeTimeout time.Duration
+
+	// EnableBDPAutoTune lets a stream's receive window grow above
+	// MaxStreamWindowSize, up to MaxAutoTuneWindowSize, when the
+	// measured bandwidth-delay product suggests a bigger window would
+	// let the peer keep more data in flight. MaxStreamWindowSize is
+	// always the floor, so disabling this preserves today's behavior.
+	EnableBDPAutoTune bool
+
+	// MaxAutoTuneWindowSize caps how large EnableBDPAutoTune is allowed
+	// to grow a stream's receive window.
+	MaxAutoTuneWindowSize uint32
+}
+
+// DefaultConfig is used to return a default configuration
+func DefaultConfig() *Config {
+	return &Config{
+		AcceptBacklog:         256,
+		EnableKeepAlive:       true,
+		KeepAliveInterval:     30 * time.Second,
+		MaxStreamWindowSize:   256 * 1024,
+		HandshakeTimeout:      10 * time.Second,
+		MaxAutoTuneWindowSize: 16 * 1024 * 1024,
+	}
+}
@@ -0,0 +1,90 @@
+package yamux
+
+import "encoding/binary"
+
+// protoVersion is the only version we support
+const protoVersion uint8 = 0
+
+const (
+	// typeData is used for data frames. They are followed
+	// by length bytes worth of payload.
+	typeData uint8 = iota
+
+	// typeWindowUpdate is used to change the window of
+	// a given stream. The length indicates the delta update.
+	typeWindowUpdate
+
+	// typePing is sent as a keep-alive or to measure
+	// the RTT. The StreamID and Length value are echoed back
+	// in the response.
+	typePing
+
+	// typeGoAway is sent to indicate that the session is
+	// being torn down.
+	typeGoAway
+)
+
+const (
+	// flagSYN is sent to signal a new stream. May
+	// be sent with a data payload.
+	flagSYN uint16 = 1 << iota
+
+	// flagACK is sent to acknowledge a new stream.
+	// May be sent with a data payload.
+	flagACK
+
+	// flagFIN is sent to half-close the given stream.
+	// May be sent with a data payload.
+	flagFIN
+
+	// flagRST is used to hard close a given stream.
+	flagRST
+)
+
+const (
+	// goAwayNormal is sent on a normal termination
+	goAwayNormal uint32 = iota
+
+	// goAwayProtoErr sent on a protocol error
+	goAwayProtoErr
+
+	// goAwayInternalErr sent on an internal error
+	goAwayInternalErr
+)
+
+const (
+	// headerSize is the size of the yamux frame header
+	headerSize = 12
+)
+
+// header is used to encode/decode frame headers. It is a slice to
+// avoid further allocations.
+type header []byte
+
+func (h header) Version() uint8 {
+	return h[0]
+}
+
+func (h header) MsgType() uint8 {
+	return h[1]
+}
+
+func (h header) Flags() uint16 {
+	return binary.BigEndian.Uint16(h[2:4])
+}
+
+func (h header) StreamID() uint32 {
+	return binary.BigEndian.Uint32(h[4:8])
+}
+
+func (h header) Length() uint32 {
+	return binary.BigEndian.Uint32(h[8:12])
+}
+
+func (h header) encode(msgType uint8, flags uint16, streamID uint32, length uint32) {
+	h[0] = protoVersion
+	h[1] = msgType
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], streamID)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
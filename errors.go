@@ -0,0 +1,50 @@
+package yamux
+
+import "fmt"
+
+var (
+	// ErrInvalidVersion means we received a frame with an
+	// invalid version
+	ErrInvalidVersion = fmt.Errorf("invalid protocol version")
+
+	// ErrInvalidMsgType means we received a frame with an
+	// invalid message type
+	ErrInvalidMsgType = fmt.Errorf("invalid msg type")
+
+	// ErrSessionShutdown is used if there is a shutdown during
+	// an operation
+	ErrSessionShutdown = fmt.Errorf("session shutdown")
+
+	// ErrStreamsExhausted is returned if we have no more
+	// stream ids to issue
+	ErrStreamsExhausted = fmt.Errorf("streams exhausted")
+
+	// ErrDuplicateStream is used if a duplicate stream is
+	// opened inbound
+	ErrDuplicateStream = fmt.Errorf("duplicate stream initiated")
+
+	// ErrRemoteGoAway is used when we get a go away from the
+	// remote side
+	ErrRemoteGoAway = fmt.Errorf("remote end is not accepting connections")
+
+	// ErrMissingStream is returned if a frame is received for a
+	// stream we don't know about
+	ErrMissingStream = fmt.Errorf("frame for missing stream")
+
+	// ErrBackchannelDisabled is returned by OpenBackchannel/AcceptBackchannel
+	// when the session was not constructed with Config.AllowBothSidesOpen
+	ErrBackchannelDisabled = fmt.Errorf("backchannel streams are disabled, set Config.AllowBothSidesOpen")
+
+	// ErrTimeout is used when an operation times out
+	ErrTimeout = fmt.Errorf("i/o deadline reached")
+
+	// ErrStreamClosed is returned when a read/write is issued
+	// to a closed stream
+	ErrStreamClosed = fmt.Errorf("stream closed")
+
+	// ErrConnectionReset is sent if a stream is reset
+	ErrConnectionReset = fmt.Errorf("connection reset")
+
+	// ErrRecvWindowExceeded indicates the window was exceeded
+	ErrRecvWindowExceeded = fmt.Errorf("recv window exceeded")
+)
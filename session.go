@@ -1,6 +1,8 @@
 package yamux
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"math"
@@ -21,11 +23,22 @@ type Session struct {
 	// conn is the underlying connection
 	conn io.ReadWriteCloser
 
+	// bw buffers writes to conn so a burst of queued frames can be
+	// flushed to the kernel in one syscall instead of one Write per
+	// frame. Only the send goroutine touches it.
+	bw *bufio.Writer
+
 	// pings is used to track inflight pings
 	pings    map[uint32]chan struct{}
 	pingID   uint32
 	pingLock sync.Mutex
 
+	// rtt is an exponentially weighted moving average of measured Ping
+	// RTTs, used by Config.EnableBDPAutoTune to size stream receive
+	// windows to the bandwidth-delay product instead of a static cap.
+	rtt     time.Duration
+	rttLock sync.Mutex
+
 	// remoteGoAway indicates the remote side does
 	// not want futher connections
 	remoteGoAway bool
@@ -45,42 +58,127 @@ type Session struct {
 	// acceptCh is used to pass ready streams to the client
 	acceptCh chan *Stream
 
-	// sendCh is used to mark a stream as ready to send,
-	// or to send a header out directly.
-	sendCh chan sendReady
+	// backchannelNextStreamID is the next stream ID we should use when
+	// opening a stream on the "reverse" parity, i.e. the parity normally
+	// reserved for the peer. It is only meaningful when
+	// config.AllowBothSidesOpen is set.
+	backchannelNextStreamID uint32
+
+	// backchannelAcceptCh is used to pass streams opened by the peer on
+	// our own parity (reverse streams) to a caller using AcceptBackchannel.
+	// It is only populated when config.AllowBothSidesOpen is set.
+	backchannelAcceptCh chan *Stream
+
+	// ctrlCh carries Ping and GoAway frames. It is drained before
+	// windowCh and dataCh so control traffic never queues behind bulk
+	// stream data. A WINDOW_UPDATE carrying FIN or RST is not control
+	// traffic by this definition: it goes through dataCh instead, behind
+	// its own stream's pending Data, so it can't leapfrog and arrive out
+	// of order (see chanFor).
+	ctrlCh chan *sendReady
+
+	// windowCh carries WINDOW_UPDATE frames, including the SYN sent by
+	// Open/OpenBackchannel. It is drained before dataCh.
+	windowCh chan *sendReady
+
+	// dataCh carries Data frames, i.e. bulk stream writes.
+	dataCh chan *sendReady
+
+	// handshakeCh is closed once the peer's first frame has been read (or
+	// reading it has failed), bounding how long Handshake and friends
+	// wait on a peer that never writes anything.
+	handshakeCh chan struct{}
 
 	// shutdown is used to safely close a session
 	shutdown     bool
 	shutdownErr  error
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
+
+	// sendDoneCh is closed once the send goroutine has returned, so Close
+	// can wait for any in-flight, buffered writes to finish instead of
+	// racing conn.Close() against the send goroutine.
+	sendDoneCh chan struct{}
+
+	// connCloseOnce guards s.conn.Close(), which both Close (after the
+	// send goroutine has drained) and exitErr (on an I/O error, where
+	// there's nothing left worth draining) may call.
+	connCloseOnce sync.Once
 }
 
 // sendReady is used to either mark a stream as ready
-// or to directly send a header
+// or to directly send a header. Instances are recycled through
+// sendReadyPool to avoid an allocation on every frame sent.
 type sendReady struct {
 	Hdr  []byte
 	Body io.Reader
 	Err  chan error
+
+	// pooledHdr is true when Hdr came from hdrPool and should be
+	// returned to it once written. Headers owned by a Stream (e.g.
+	// stream.sendHdr) are reused by their owner and must never be
+	// recycled here.
+	pooledHdr bool
+}
+
+// sendReadyPool recycles sendReady structs across frames.
+var sendReadyPool = sync.Pool{
+	New: func() interface{} { return new(sendReady) },
+}
+
+// hdrPool recycles the 12-byte header buffers used for control frames
+// (Ping, GoAway, RST) that are built fresh on every call.
+var hdrPool = sync.Pool{
+	New: func() interface{} { return make([]byte, headerSize) },
+}
+
+// newHdr returns a pooled, zeroed header-sized buffer.
+func newHdr() header {
+	hdr := hdrPool.Get().([]byte)
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	return header(hdr)
 }
 
 // newSession is used to construct a new session
 func newSession(config *Config, conn io.ReadWriteCloser, client bool) *Session {
 	s := &Session{
-		client:     client,
-		config:     config,
-		conn:       conn,
-		pings:      make(map[uint32]chan struct{}),
-		streams:    make(map[uint32]*Stream),
-		acceptCh:   make(chan *Stream, config.AcceptBacklog),
-		sendCh:     make(chan sendReady, 64),
-		shutdownCh: make(chan struct{}),
+		client:      client,
+		config:      config,
+		conn:        conn,
+		bw:          bufio.NewWriter(conn),
+		pings:       make(map[uint32]chan struct{}),
+		streams:     make(map[uint32]*Stream),
+		acceptCh:    make(chan *Stream, config.AcceptBacklog),
+		ctrlCh:      make(chan *sendReady, 8),
+		windowCh:    make(chan *sendReady, 64),
+		dataCh:      make(chan *sendReady, 64),
+		shutdownCh:  make(chan struct{}),
+		handshakeCh: make(chan struct{}),
+		sendDoneCh:  make(chan struct{}),
 	}
 	if client {
 		s.nextStreamID = 1
 	} else {
 		s.nextStreamID = 2
 	}
+	if config.AllowBothSidesOpen {
+		s.backchannelAcceptCh = make(chan *Stream, config.AcceptBacklog)
+		// Forward and backchannel streams each need their own disjoint
+		// ID space, so a normal forward stream opened by one side can
+		// never collide with a backchannel stream opened by the other.
+		// We use four mod-4 buckets: client forward (1), server forward
+		// (2), server backchannel (3), client backchannel (0, i.e. 4).
+		// nextStreamID above already claimed buckets 1/2; give
+		// backchannel streams the other two, stepping by 4 in both
+		// cases to stay within a bucket.
+		if client {
+			s.backchannelNextStreamID = 4
+		} else {
+			s.backchannelNextStreamID = 3
+		}
+	}
 	go s.recv()
 	go s.send()
 	if config.EnableKeepAlive {
@@ -101,6 +199,23 @@ func (s *Session) isShutdown() bool {
 
 // Open is used to create a new stream
 func (s *Session) Open() (*Stream, error) {
+	return s.openStream(false)
+}
+
+// OpenBackchannel is used by the passive side of a session to open a
+// stream back to the peer that dialed it, e.g. so a gRPC server can make
+// calls on the same connection a client used to reach it. It is only
+// valid when the session was created with Config.AllowBothSidesOpen.
+func (s *Session) OpenBackchannel() (*Stream, error) {
+	if !s.config.AllowBothSidesOpen {
+		return nil, ErrBackchannelDisabled
+	}
+	return s.openStream(true)
+}
+
+// openStream allocates and registers a new stream, optionally on the
+// reverse parity reserved for backchannel streams.
+func (s *Session) openStream(backchannel bool) (*Stream, error) {
 	if s.isShutdown() {
 		return nil, ErrSessionShutdown
 	}
@@ -111,12 +226,24 @@ func (s *Session) Open() (*Stream, error) {
 	s.streamLock.Lock()
 	defer s.streamLock.Unlock()
 
+	// The four-bucket, step-by-4 ID space is only needed once backchannel
+	// streams are in play; a plain session has no reverse parity to stay
+	// clear of, so it keeps the original step-by-2 allocation.
+	step := uint32(2)
+	if backchannel || s.config.AllowBothSidesOpen {
+		step = 4
+	}
+
 	// Check if we've exhaused the streams
-	id := s.nextStreamID
-	if id >= math.MaxUint32-1 {
+	idPtr := &s.nextStreamID
+	if backchannel {
+		idPtr = &s.backchannelNextStreamID
+	}
+	id := *idPtr
+	if id >= math.MaxUint32-step {
 		return nil, ErrStreamsExhausted
 	}
-	s.nextStreamID += 2
+	*idPtr += step
 
 	// Register the stream
 	stream := newStream(s, id, streamInit)
@@ -143,28 +270,90 @@ func (s *Session) AcceptStream() (*Stream, error) {
 	}
 }
 
+// AcceptBackchannel is used to block until the peer opens a stream on the
+// parity we reserve for ourselves, i.e. a stream it initiated back to us.
+// It is only valid when the session was created with
+// Config.AllowBothSidesOpen; use Listener() to adapt it to a net.Listener.
+func (s *Session) AcceptBackchannel() (*Stream, error) {
+	if !s.config.AllowBothSidesOpen {
+		return nil, ErrBackchannelDisabled
+	}
+	select {
+	case stream := <-s.backchannelAcceptCh:
+		return stream, nil
+	case <-s.shutdownCh:
+		return nil, s.shutdownErr
+	}
+}
+
+// closeSendDrainTimeout bounds how long Close waits for the send
+// goroutine to finish flushing before forcing the conn closed. A peer
+// that stops reading (or a full socket buffer) can park send() inside a
+// blocking conn.Write/bufio.Writer.Flush indefinitely, and closing the
+// conn is the only thing that unblocks it, so Close must not wait on
+// sendDoneCh forever.
+const closeSendDrainTimeout = 5 * time.Second
+
 // Close is used to close the session and all streams.
 // Attempts to send a GoAway before closing the connection.
 func (s *Session) Close() error {
+	s.teardown(nil)
+
+	// Give the send goroutine a chance to flush whatever was already
+	// buffered before closing the conn out from under it, so a frame
+	// queued just before Close is called still has a chance to reach
+	// the wire instead of failing against an already-closed conn. Bound
+	// the wait: if send is stuck in a blocking write to an unresponsive
+	// peer, only closeConn can unblock it.
+	select {
+	case <-s.sendDoneCh:
+	case <-time.After(closeSendDrainTimeout):
+	}
+	s.closeConn()
+	return nil
+}
+
+// teardown performs the shared, non-blocking shutdown bookkeeping. It is
+// safe to call from the send goroutine itself (via exitErr), unlike
+// Close, because it never waits on sendDoneCh. It deliberately does not
+// close the conn: Close does that itself once the send goroutine has
+// drained, and exitErr does it directly since an I/O error means there's
+// nothing left worth draining.
+//
+// err, if non-nil, becomes shutdownErr; it is ignored once shutdownErr is
+// already set so the first error to trigger shutdown wins. Every write
+// to shutdownErr happens here under shutdownLock, so callers such as
+// exitErr must never set it directly.
+func (s *Session) teardown(err error) {
 	s.shutdownLock.Lock()
 	defer s.shutdownLock.Unlock()
 
 	if s.shutdown {
-		return nil
+		return
 	}
 	s.shutdown = true
+	if s.shutdownErr == nil {
+		s.shutdownErr = err
+	}
 	if s.shutdownErr == nil {
 		s.shutdownErr = ErrSessionShutdown
 	}
 	close(s.shutdownCh)
-	s.conn.Close()
 
 	s.streamLock.Lock()
 	defer s.streamLock.Unlock()
 	for _, stream := range s.streams {
 		stream.forceClose()
 	}
-	return nil
+}
+
+// closeConn closes the underlying connection exactly once, whether that
+// happens from Close (after the send goroutine drains) or from exitErr
+// (immediately, since the conn already failed).
+func (s *Session) closeConn() {
+	s.connCloseOnce.Do(func() {
+		s.conn.Close()
+	})
 }
 
 // GoAway can be used to prevent accepting further
@@ -188,9 +377,9 @@ func (s *Session) Ping() (time.Duration, error) {
 	s.pingLock.Unlock()
 
 	// Send the ping request
-	hdr := header(make([]byte, headerSize))
+	hdr := newHdr()
 	hdr.encode(typePing, flagSYN, 0, id)
-	if err := s.waitForSend(hdr, nil); err != nil {
+	if err := s.waitForSendFlags(hdr, nil, true); err != nil {
 		return 0, err
 	}
 
@@ -203,7 +392,34 @@ func (s *Session) Ping() (time.Duration, error) {
 	}
 
 	// Compute the RTT
-	return time.Now().Sub(start), nil
+	rtt := time.Now().Sub(start)
+	s.updateRTT(rtt)
+	return rtt, nil
+}
+
+// rttEWMAWeight is the weight given to each new RTT sample when updating
+// the moving average; lower values smooth over more history.
+const rttEWMAWeight = 0.2
+
+// updateRTT folds a new Ping RTT sample into the moving average used for
+// BDP-based window auto-tuning.
+func (s *Session) updateRTT(sample time.Duration) {
+	s.rttLock.Lock()
+	defer s.rttLock.Unlock()
+	if s.rtt == 0 {
+		s.rtt = sample
+		return
+	}
+	s.rtt = time.Duration(float64(s.rtt)*(1-rttEWMAWeight) + float64(sample)*rttEWMAWeight)
+}
+
+// measuredRTT returns the current RTT estimate, or zero if no Ping has
+// completed yet. Streams consult this when Config.EnableBDPAutoTune is
+// set to decide whether their receive window should grow.
+func (s *Session) measuredRTT() time.Duration {
+	s.rttLock.Lock()
+	defer s.rttLock.Unlock()
+	return s.rtt
 }
 
 // keepalive is a long running goroutine that periodically does
@@ -219,13 +435,43 @@ func (s *Session) keepalive() {
 	}
 }
 
+// chanFor returns the channel a frame should be queued on, so that Ping,
+// GoAway, and plain credit updates can't get stuck behind bulk Data
+// frames from other streams. A WindowUpdate frame carrying FIN or RST
+// is the exception: it closes out a particular stream, so it must not
+// leapfrog that same stream's still-queued Data on the higher-priority
+// windowCh and arrive out of order. It goes through dataCh instead,
+// behind that stream's own pending writes but still ahead of other
+// streams' unrelated Data.
+func (s *Session) chanFor(hdr header) chan *sendReady {
+	switch hdr.MsgType() {
+	case typeWindowUpdate:
+		if hdr.Flags()&(flagFIN|flagRST) != 0 {
+			return s.dataCh
+		}
+		return s.windowCh
+	case typeData:
+		return s.dataCh
+	default:
+		return s.ctrlCh
+	}
+}
+
 // waitForSend waits to send a header, checking for a potential shutdown
 func (s *Session) waitForSend(hdr header, body io.Reader) error {
+	return s.waitForSendFlags(hdr, body, false)
+}
+
+// waitForSendFlags is waitForSend with control over whether hdr came
+// from hdrPool and should be recycled once written.
+func (s *Session) waitForSendFlags(hdr header, body io.Reader, pooledHdr bool) error {
 	errCh := make(chan error, 1)
-	ready := sendReady{Hdr: hdr, Body: body, Err: errCh}
+	ready := sendReadyPool.Get().(*sendReady)
+	ready.Hdr, ready.Body, ready.Err, ready.pooledHdr = hdr, body, errCh, pooledHdr
 	select {
-	case s.sendCh <- ready:
+	case s.chanFor(hdr) <- ready:
 	case <-s.shutdownCh:
+		sendReadyPool.Put(ready)
 		return ErrSessionShutdown
 	}
 	select {
@@ -238,91 +484,273 @@ func (s *Session) waitForSend(hdr header, body io.Reader) error {
 
 // sendNoWait does a send without waiting
 func (s *Session) sendNoWait(hdr header) error {
+	return s.sendNoWaitFlags(hdr, false)
+}
+
+// sendNoWaitFlags is sendNoWait with control over whether hdr came from
+// hdrPool and should be recycled once written.
+func (s *Session) sendNoWaitFlags(hdr header, pooledHdr bool) error {
+	ready := sendReadyPool.Get().(*sendReady)
+	ready.Hdr, ready.Body, ready.Err, ready.pooledHdr = hdr, nil, nil, pooledHdr
 	select {
-	case s.sendCh <- sendReady{Hdr: hdr}:
+	case s.chanFor(hdr) <- ready:
 		return nil
 	case <-s.shutdownCh:
+		sendReadyPool.Put(ready)
 		return ErrSessionShutdown
 	}
 }
 
-// send is a long running goroutine that sends data
+// sendCoalesceMax bounds how many frames, counting the first one, the
+// send loop will fold into the same buffered write before flushing.
+const sendCoalesceMax = 16
+
+// send is a long running goroutine that sends data. Frames are written
+// through a buffered writer so a burst of small frames (acks, window
+// updates, or interleaved Data writes from many streams) reaches the
+// kernel in one syscall instead of one Write per frame.
 func (s *Session) send() {
+	defer close(s.sendDoneCh)
+	var pending []chan error
 	for {
-		select {
-		case ready := <-s.sendCh:
-			// Send a header if ready
-			if ready.Hdr != nil {
-				sent := 0
-				for sent < len(ready.Hdr) {
-					n, err := s.conn.Write(ready.Hdr[sent:])
-					if err != nil {
-						s.exitErr(err)
-						asyncSendErr(ready.Err, err)
-						return
-					}
-					sent += n
-				}
+		ready, ok := s.nextReady()
+		if !ok {
+			s.flushPending(pending)
+			return
+		}
+		errCh, ok := s.writeFrame(ready)
+		if !ok {
+			return
+		}
+		pending = append(pending, errCh)
+
+		for coalesced := 1; coalesced < sendCoalesceMax; coalesced++ {
+			more, ok := s.tryNextReady()
+			if !ok {
+				break
 			}
+			errCh, ok := s.writeFrame(more)
+			if !ok {
+				return
+			}
+			pending = append(pending, errCh)
+		}
+		if err := s.flushPending(pending); err != nil {
+			return
+		}
+		pending = pending[:0]
+	}
+}
 
-			// Send data from a body if given
-			if ready.Body != nil {
-				_, err := io.Copy(s.conn, ready.Body)
-				if err != nil {
-					s.exitErr(err)
-					asyncSendErr(ready.Err, err)
-					return
-				}
+// flushPending flushes the buffered writer and only then reports the
+// result to every frame coalesced into this batch, so a caller waiting
+// on waitForSend is never told its write succeeded before the bytes
+// actually reached the socket.
+func (s *Session) flushPending(pending []chan error) error {
+	err := s.bw.Flush()
+	if err != nil {
+		s.exitErr(err)
+	}
+	for _, ch := range pending {
+		asyncSendErr(ch, err)
+	}
+	return err
+}
+
+// nextReady blocks for the next frame to send, preferring ctrlCh, then
+// windowCh, then dataCh, so control traffic never queues behind bulk
+// stream data. It reports ok=false if the session is shutting down.
+//
+// shutdownCh only ever appears in the final, blocking select below, and
+// only after a non-blocking pass over ctrlCh/windowCh/dataCh has come up
+// empty. Putting shutdownCh in the same select as those channels would
+// let Go's uniform random case choice drop an already-queued frame in
+// favor of shutdown instead of draining it, which is exactly what
+// Close/teardown rely on not happening.
+func (s *Session) nextReady() (*sendReady, bool) {
+	select {
+	case ready := <-s.ctrlCh:
+		return ready, true
+	default:
+	}
+	select {
+	case ready := <-s.ctrlCh:
+		return ready, true
+	case ready := <-s.windowCh:
+		return ready, true
+	default:
+	}
+	select {
+	case ready := <-s.ctrlCh:
+		return ready, true
+	case ready := <-s.windowCh:
+		return ready, true
+	case ready := <-s.dataCh:
+		return ready, true
+	default:
+	}
+	select {
+	case ready := <-s.ctrlCh:
+		return ready, true
+	case ready := <-s.windowCh:
+		return ready, true
+	case ready := <-s.dataCh:
+		return ready, true
+	case <-s.shutdownCh:
+		return nil, false
+	}
+}
+
+// tryNextReady is the non-blocking counterpart of nextReady, used to
+// coalesce any further already-queued frames onto the same buffered
+// write before it is flushed.
+func (s *Session) tryNextReady() (*sendReady, bool) {
+	select {
+	case ready := <-s.ctrlCh:
+		return ready, true
+	default:
+	}
+	select {
+	case ready := <-s.windowCh:
+		return ready, true
+	default:
+	}
+	select {
+	case ready := <-s.dataCh:
+		return ready, true
+	default:
+		return nil, false
+	}
+}
+
+// writeFrame copies a single queued frame into the buffered writer and
+// returns the frame's resources to their pools. It does not signal
+// ready.Err on success: the bytes aren't actually on the wire until the
+// caller flushes, so it returns ready.Err for the caller to notify once
+// that flush completes. It returns ok=false if the session should stop
+// sending because the connection failed, having already signaled
+// ready.Err itself in that case.
+func (s *Session) writeFrame(ready *sendReady) (errCh chan error, ok bool) {
+	// Send a header if ready
+	if ready.Hdr != nil {
+		sent := 0
+		for sent < len(ready.Hdr) {
+			n, err := s.bw.Write(ready.Hdr[sent:])
+			if err != nil {
+				s.exitErr(err)
+				asyncSendErr(ready.Err, err)
+				return nil, false
 			}
+			sent += n
+		}
+	}
 
-			// No error, successful send
-			asyncSendErr(ready.Err, nil)
-		case <-s.shutdownCh:
-			return
+	// Send data from a body if given
+	if ready.Body != nil {
+		_, err := io.Copy(s.bw, ready.Body)
+		if err != nil {
+			s.exitErr(err)
+			asyncSendErr(ready.Err, err)
+			return nil, false
 		}
 	}
+
+	errCh, hdr, pooledHdr := ready.Err, ready.Hdr, ready.pooledHdr
+	ready.Hdr, ready.Body, ready.Err, ready.pooledHdr = nil, nil, nil, false
+	sendReadyPool.Put(ready)
+	if pooledHdr {
+		hdrPool.Put(hdr)
+	}
+	return errCh, true
+}
+
+// Handshake blocks until the peer's first frame has been read, bounded
+// by Config.HandshakeTimeout when the conn is a net.Conn, or until ctx is
+// done. Callers that want to
+// gate something like grpc.NewServer on a successfully negotiated
+// connection should call this before Accepting streams. The first frame
+// read is also a natural place for a future capability bitmap to be
+// exchanged so both sides agree on optional extensions (e.g. backchannel
+// or BDP auto-tune) before any stream traffic flows.
+func (s *Session) Handshake(ctx context.Context) error {
+	select {
+	case <-s.handshakeCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.isShutdown() {
+		return s.shutdownErr
+	}
+	return nil
 }
 
 // recv is a long running goroutine that accepts new data
 func (s *Session) recv() {
 	hdr := header(make([]byte, headerSize))
+
+	// The first frame is bounded by Config.HandshakeTimeout so a
+	// connection that never writes anything (e.g. a slow-loris probe
+	// against a Server) can't park this goroutine in io.ReadFull forever.
+	// On failure, shut the session down before closing handshakeCh so
+	// Handshake never sees a failed first read as success.
+	err := s.readHandshakeFrame(hdr)
+	if err != nil {
+		s.exitErr(err)
+		close(s.handshakeCh)
+		return
+	}
+	close(s.handshakeCh)
+	if err := s.handleFrame(hdr); err != nil {
+		s.exitErr(err)
+		return
+	}
+
 	for !s.isShutdown() {
 		// Read the header
 		if _, err := io.ReadFull(s.conn, hdr); err != nil {
 			s.exitErr(err)
 			return
 		}
-
-		// Verify the version
-		if hdr.Version() != protoVersion {
-			s.exitErr(ErrInvalidVersion)
+		if err := s.handleFrame(hdr); err != nil {
+			s.exitErr(err)
 			return
 		}
+	}
+}
 
-		// Switch on the type
-		msgType := hdr.MsgType()
-		switch msgType {
-		case typeData:
-			fallthrough
-		case typeWindowUpdate:
-			if err := s.handleStreamMessage(hdr); err != nil {
-				s.exitErr(err)
-				return
-			}
-		case typeGoAway:
-			if err := s.handleGoAway(hdr); err != nil {
-				s.exitErr(err)
-				return
-			}
-		case typePing:
-			if err := s.handlePing(hdr); err != nil {
-				s.exitErr(err)
-				return
-			}
-		default:
-			s.exitErr(ErrInvalidMsgType)
-			return
+// readHandshakeFrame reads the first frame from the peer, applying
+// Config.HandshakeTimeout as a read deadline when the underlying conn
+// supports one.
+func (s *Session) readHandshakeFrame(hdr header) error {
+	if conn, ok := s.conn.(net.Conn); ok && s.config.HandshakeTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.config.HandshakeTimeout)); err != nil {
+			return err
 		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	_, err := io.ReadFull(s.conn, hdr)
+	return err
+}
+
+// handleFrame verifies and routes a single frame header.
+func (s *Session) handleFrame(hdr header) error {
+	// Verify the version
+	if hdr.Version() != protoVersion {
+		return ErrInvalidVersion
+	}
+
+	// Switch on the type
+	switch hdr.MsgType() {
+	case typeData:
+		fallthrough
+	case typeWindowUpdate:
+		return s.handleStreamMessage(hdr)
+	case typeGoAway:
+		return s.handleGoAway(hdr)
+	case typePing:
+		return s.handlePing(hdr)
+	default:
+		return ErrInvalidMsgType
 	}
 }
 
@@ -371,9 +799,9 @@ func (s *Session) handlePing(hdr header) error {
 
 	// Check if this is a query, respond back
 	if flags&flagSYN == flagSYN {
-		hdr := header(make([]byte, headerSize))
+		hdr := newHdr()
 		hdr.encode(typePing, flagACK, 0, pingID)
-		s.sendNoWait(hdr)
+		s.sendNoWaitFlags(hdr, true)
 		return nil
 	}
 
@@ -405,26 +833,27 @@ func (s *Session) handleGoAway(hdr header) error {
 }
 
 // exitErr is used to handle an error that is causing
-// the listener to exit.
+// the listener to exit. It must not call Close directly: Close waits on
+// sendDoneCh, and exitErr can be called from the send goroutine itself.
 func (s *Session) exitErr(err error) {
-	s.shutdownErr = err
-	s.Close()
+	s.teardown(err)
+	s.closeConn()
 }
 
 // goAway is used to send a goAway message
 func (s *Session) goAway(reason uint32) {
-	hdr := header(make([]byte, headerSize))
+	hdr := newHdr()
 	hdr.encode(typeGoAway, 0, 0, reason)
-	s.sendNoWait(hdr)
+	s.sendNoWaitFlags(hdr, true)
 }
 
 // incomingStream is used to create a new incoming stream
 func (s *Session) incomingStream(id uint32) error {
 	// Reject immediately if we are doing a go away
 	if s.localGoAway {
-		hdr := header(make([]byte, headerSize))
+		hdr := newHdr()
 		hdr.encode(typeWindowUpdate, flagRST, id, 0)
-		s.sendNoWait(hdr)
+		s.sendNoWaitFlags(hdr, true)
 		return nil
 	}
 
@@ -442,9 +871,28 @@ func (s *Session) incomingStream(id uint32) error {
 	stream := newStream(s, id, streamSYNReceived)
 	s.streams[id] = stream
 
+	// Backchannel streams live in their own mod-4 bucket, disjoint from
+	// both sides' forward-stream buckets (see newSession), so route a
+	// SYN into the backchannel accept channel purely based on which
+	// bucket its ID falls in rather than comparing parity against our
+	// own nextStreamID, which only tracks our own forward streams.
+	acceptCh := s.acceptCh
+	if s.config.AllowBothSidesOpen {
+		// We are the client, so a backchannel stream from the peer
+		// (server) falls in the server-backchannel bucket (3), and
+		// vice versa.
+		peerBackchannelBucket := uint32(0)
+		if s.client {
+			peerBackchannelBucket = 3
+		}
+		if id%4 == peerBackchannelBucket {
+			acceptCh = s.backchannelAcceptCh
+		}
+	}
+
 	// Check if we've exceeded the backlog
 	select {
-	case s.acceptCh <- stream:
+	case acceptCh <- stream:
 		return nil
 	default:
 		// Backlog exceeded! RST the stream
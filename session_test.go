@@ -0,0 +1,95 @@
+package yamux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClientServer returns a connected pair of client/server Sessions
+// wired together with net.Pipe, using DefaultConfig with keepalive
+// disabled so tests control pings explicitly.
+func testClientServer(tb testing.TB) (client *Session, server *Session) {
+	tb.Helper()
+	conn1, conn2 := net.Pipe()
+
+	conf := DefaultConfig()
+	conf.EnableKeepAlive = false
+
+	client = newSession(conf, conn1, true)
+	server = newSession(conf, conn2, false)
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestPing(t *testing.T) {
+	client, server := testClientServer(t)
+
+	go func() {
+		s, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, s)
+	}()
+
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected a positive RTT, got %v", rtt)
+	}
+}
+
+// BenchmarkPingUnderLoad measures Ping RTT while a stream is flooding
+// the same session with Data frames, to demonstrate that control frames
+// on ctrlCh/windowCh no longer queue behind bulk Data on dataCh.
+func BenchmarkPingUnderLoad(b *testing.B) {
+	client, server := testClientServer(b)
+
+	serverStream, err := server.Open()
+	if err != nil {
+		b.Fatalf("open failed: %v", err)
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		cs, err := client.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, cs)
+	}()
+	go func() {
+		payload := make([]byte, 16*1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := serverStream.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Let the flood ramp up before measuring.
+	time.Sleep(10 * time.Millisecond)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Ping(); err != nil {
+			b.Fatalf("ping failed: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	close(stop)
+	serverStream.Close()
+}
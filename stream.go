@@ -0,0 +1,458 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type streamState int
+
+const (
+	streamInit streamState = iota
+	streamSYNSent
+	streamSYNReceived
+	streamEstablished
+	streamLocalClose
+	streamRemoteClose
+	streamClosed
+	streamReset
+)
+
+// Stream is used to represent a logical stream
+// within a session.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	state     streamState
+	stateLock sync.Mutex
+
+	recvBuf  bytes.Buffer
+	recvLock sync.Mutex
+
+	recvWindow uint32
+	sendWindow uint32
+	windowLock sync.Mutex
+
+	// dynamicWindowCap is the current ceiling sendWindowUpdate grows
+	// recvWindow towards. It starts at, and never drops below,
+	// Config.MaxStreamWindowSize; when Config.EnableBDPAutoTune is set,
+	// readData may raise it (capped at Config.MaxAutoTuneWindowSize) as
+	// the measured bandwidth-delay product grows.
+	dynamicWindowCap uint32
+
+	// deliveredSinceGrow and lastGrow track inbound throughput since the
+	// window last grew (or the stream was created), used to estimate
+	// bytesPerRTT.
+	deliveredSinceGrow uint32
+	lastGrow           time.Time
+
+	// controlHdr is reused across WindowUpdate frames sent for this
+	// stream (SYN/ACK credit updates, FIN), guarded by controlHdrLock
+	// since sendWindowUpdate and Close can both want to encode into it
+	// concurrently. sendHdr is reused across Data frames, guarded by
+	// sendLock so concurrent Writes don't race on it; incomingStream
+	// also uses it for the RST it sends when the accept backlog is full,
+	// before the stream is handed out. Neither is ever recycled into
+	// hdrPool.
+	controlHdr     header
+	controlHdrLock sync.Mutex
+	sendHdr        header
+	sendLock       sync.Mutex
+
+	recvNotifyCh chan struct{}
+	sendNotifyCh chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	deadlineLock  sync.Mutex
+}
+
+// newStream is used to construct a new stream within
+// a given session for an ID
+func newStream(session *Session, id uint32, state streamState) *Stream {
+	s := &Stream{
+		id:               id,
+		session:          session,
+		state:            state,
+		controlHdr:       header(make([]byte, headerSize)),
+		sendHdr:          header(make([]byte, headerSize)),
+		recvWindow:       session.config.MaxStreamWindowSize,
+		sendWindow:       session.config.MaxStreamWindowSize,
+		dynamicWindowCap: session.config.MaxStreamWindowSize,
+		lastGrow:         time.Now(),
+		recvNotifyCh:     make(chan struct{}, 1),
+		sendNotifyCh:     make(chan struct{}, 1),
+	}
+	return s
+}
+
+// Session returns the session this stream is associated with
+func (s *Stream) Session() *Session {
+	return s.session
+}
+
+// StreamID returns the ID of this stream
+func (s *Stream) StreamID() uint32 {
+	return s.id
+}
+
+// Read is used to read from the stream
+func (s *Stream) Read(b []byte) (n int, err error) {
+	defer asyncNotify(s.recvNotifyCh)
+START:
+	s.stateLock.Lock()
+	switch s.state {
+	case streamLocalClose, streamRemoteClose, streamClosed, streamReset:
+		s.recvLock.Lock()
+		empty := s.recvBuf.Len() == 0
+		s.recvLock.Unlock()
+		if empty {
+			s.stateLock.Unlock()
+			if s.state == streamReset {
+				return 0, ErrConnectionReset
+			}
+			return 0, io.EOF
+		}
+	}
+	s.stateLock.Unlock()
+
+	s.recvLock.Lock()
+	if s.recvBuf.Len() == 0 {
+		s.recvLock.Unlock()
+		goto WAIT
+	}
+	n, _ = s.recvBuf.Read(b)
+	s.recvLock.Unlock()
+	s.sendWindowUpdate()
+	return n, nil
+
+WAIT:
+	var timeout <-chan time.Time
+	s.deadlineLock.Lock()
+	deadline := s.readDeadline
+	s.deadlineLock.Unlock()
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-s.recvNotifyCh:
+		goto START
+	case <-timeout:
+		return 0, ErrTimeout
+	case <-s.session.shutdownCh:
+		return 0, ErrSessionShutdown
+	}
+}
+
+// Write is used to write to the stream
+func (s *Stream) Write(b []byte) (n int, err error) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	total := 0
+	for total < len(b) {
+		n, err := s.writeChunk(b[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// writeChunk is used to write a single data frame, respecting the
+// current send window. It blocks until at least some of b can be sent.
+// Must be called with sendLock held.
+func (s *Stream) writeChunk(b []byte) (n int, err error) {
+START:
+	s.stateLock.Lock()
+	switch s.state {
+	case streamLocalClose, streamClosed, streamReset:
+		s.stateLock.Unlock()
+		return 0, ErrStreamClosed
+	}
+	flags := s.sendFlags()
+	s.stateLock.Unlock()
+
+	s.windowLock.Lock()
+	window := s.sendWindow
+	s.windowLock.Unlock()
+	if window == 0 {
+		goto WAIT
+	}
+
+	{
+		max := min(window, uint32(len(b)))
+		body := bytes.NewReader(b[:max])
+		s.sendHdr.encode(typeData, flags, s.id, max)
+		if err := s.session.waitForSend(s.sendHdr, body); err != nil {
+			return 0, err
+		}
+		s.windowLock.Lock()
+		s.sendWindow -= max
+		s.windowLock.Unlock()
+		return int(max), nil
+	}
+
+WAIT:
+	var timeout <-chan time.Time
+	s.deadlineLock.Lock()
+	deadline := s.writeDeadline
+	s.deadlineLock.Unlock()
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-s.sendNotifyCh:
+		goto START
+	case <-timeout:
+		return 0, ErrTimeout
+	case <-s.session.shutdownCh:
+		return 0, ErrSessionShutdown
+	}
+}
+
+// sendFlags determines any flags that are appropriate based on the
+// current stream state, advancing the state as a side effect. Must be
+// called with stateLock held.
+func (s *Stream) sendFlags() uint16 {
+	switch s.state {
+	case streamInit:
+		s.state = streamSYNSent
+		return flagSYN
+	case streamSYNReceived:
+		s.state = streamEstablished
+		return flagACK
+	default:
+		return 0
+	}
+}
+
+// sendWindowUpdate is used to send a window update, granting more receive
+// credit to the peer, piggy-backing any outstanding SYN/ACK flags.
+func (s *Stream) sendWindowUpdate() error {
+	s.controlHdrLock.Lock()
+	defer s.controlHdrLock.Unlock()
+
+	s.stateLock.Lock()
+	flags := s.sendFlags()
+	s.stateLock.Unlock()
+
+	s.recvLock.Lock()
+	max := s.dynamicWindowCap
+	bufLen := uint32(s.recvBuf.Len())
+	delta := (max - bufLen) - s.recvWindow
+	s.recvLock.Unlock()
+
+	// Only bother the peer once there's a meaningful amount of credit to
+	// hand back, unless we have a flag that must go out regardless.
+	if delta < max/2 && flags == 0 {
+		return nil
+	}
+
+	s.recvLock.Lock()
+	s.recvWindow += delta
+	s.recvLock.Unlock()
+
+	s.controlHdr.encode(typeWindowUpdate, flags, s.id, delta)
+	return s.session.waitForSend(s.controlHdr, nil)
+}
+
+// incrSendWindow is called when we receive a WindowUpdate frame for this
+// stream, and processes any FIN/RST flags it carries.
+func (s *Stream) incrSendWindow(hdr header, flags uint16) error {
+	if err := s.processFlags(flags); err != nil {
+		return err
+	}
+	s.windowLock.Lock()
+	s.sendWindow += hdr.Length()
+	s.windowLock.Unlock()
+	asyncNotify(s.sendNotifyCh)
+	return nil
+}
+
+// readData is called by handleStreamMessage for every Data and
+// WindowUpdate frame on this stream. A WindowUpdate has already been
+// applied by incrSendWindow and carries no payload (its Length is a
+// window delta), so it is ignored here.
+func (s *Stream) readData(hdr header, flags uint16, conn io.Reader) error {
+	if hdr.MsgType() != typeData {
+		return nil
+	}
+	if err := s.processFlags(flags); err != nil {
+		return err
+	}
+
+	length := hdr.Length()
+	if length == 0 {
+		return nil
+	}
+
+	s.recvLock.Lock()
+	if length > s.recvWindow {
+		s.recvLock.Unlock()
+		return ErrRecvWindowExceeded
+	}
+	s.recvWindow -= length
+	_, err := io.CopyN(&s.recvBuf, conn, int64(length))
+	if err == nil {
+		s.deliveredSinceGrow += length
+	}
+	s.recvLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.maybeGrowWindow()
+	asyncNotify(s.recvNotifyCh)
+	return nil
+}
+
+// maybeGrowWindow implements Config.EnableBDPAutoTune: it estimates the
+// bandwidth-delay product from bytes delivered since the last check and
+// the session's measured RTT, and geometrically grows dynamicWindowCap
+// (capped at Config.MaxAutoTuneWindowSize) whenever the current window
+// is under roughly 2x that estimate, so sendWindowUpdate can advertise a
+// bigger window back to the peer.
+func (s *Stream) maybeGrowWindow() {
+	cfg := s.session.config
+	if !cfg.EnableBDPAutoTune {
+		return
+	}
+	rtt := s.session.measuredRTT()
+	if rtt <= 0 {
+		return
+	}
+
+	s.recvLock.Lock()
+	defer s.recvLock.Unlock()
+
+	elapsed := time.Since(s.lastGrow)
+	if elapsed <= 0 {
+		return
+	}
+	throughput := float64(s.deliveredSinceGrow) / elapsed.Seconds()
+	bytesPerRTT := uint32(throughput * rtt.Seconds())
+
+	if s.dynamicWindowCap >= cfg.MaxAutoTuneWindowSize || s.dynamicWindowCap >= 2*bytesPerRTT {
+		return
+	}
+	grown := s.dynamicWindowCap * 2
+	if grown > cfg.MaxAutoTuneWindowSize {
+		grown = cfg.MaxAutoTuneWindowSize
+	}
+	s.dynamicWindowCap = grown
+	s.deliveredSinceGrow = 0
+	s.lastGrow = time.Now()
+}
+
+// processFlags is used to update the state of the stream
+// based on the FIN/RST flags carried on an incoming frame.
+// Must not be called with stateLock held.
+func (s *Stream) processFlags(flags uint16) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	if flags&flagACK == flagACK && s.state == streamSYNSent {
+		s.state = streamEstablished
+	}
+	if flags&flagFIN == flagFIN {
+		switch s.state {
+		case streamLocalClose:
+			s.state = streamClosed
+			s.session.closeStream(s.id, false)
+		default:
+			s.state = streamRemoteClose
+		}
+		asyncNotify(s.recvNotifyCh)
+	}
+	if flags&flagRST == flagRST {
+		s.state = streamReset
+		s.session.closeStream(s.id, false)
+		asyncNotify(s.recvNotifyCh)
+		asyncNotify(s.sendNotifyCh)
+	}
+	return nil
+}
+
+// Close is used to close the stream, sending a FIN to the peer. It is a
+// no-op if the stream is already locally closed, closed or reset.
+func (s *Stream) Close() error {
+	s.stateLock.Lock()
+	switch s.state {
+	case streamLocalClose, streamClosed, streamReset:
+		s.stateLock.Unlock()
+		return nil
+	case streamRemoteClose:
+		s.state = streamClosed
+		s.session.closeStream(s.id, false)
+	default:
+		s.state = streamLocalClose
+	}
+	s.stateLock.Unlock()
+
+	s.controlHdrLock.Lock()
+	defer s.controlHdrLock.Unlock()
+	s.controlHdr.encode(typeWindowUpdate, flagFIN, s.id, 0)
+	return s.session.waitForSend(s.controlHdr, nil)
+}
+
+// forceClose is used by the session during teardown to unblock any
+// pending Read/Write on the stream.
+func (s *Stream) forceClose() {
+	s.stateLock.Lock()
+	s.state = streamClosed
+	s.stateLock.Unlock()
+	asyncNotify(s.recvNotifyCh)
+	asyncNotify(s.sendNotifyCh)
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (s *Stream) LocalAddr() net.Addr {
+	if conn, ok := s.session.conn.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *Stream) RemoteAddr() net.Addr {
+	if conn, ok := s.session.conn.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// SetDeadline sets both the read and write deadlines
+func (s *Stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	s.readDeadline = t
+	s.deadlineLock.Unlock()
+	asyncNotify(s.recvNotifyCh)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	s.writeDeadline = t
+	s.deadlineLock.Unlock()
+	asyncNotify(s.sendNotifyCh)
+	return nil
+}
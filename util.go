@@ -0,0 +1,31 @@
+package yamux
+
+// asyncSendErr sends an error to a channel in a non-blocking fashion. The
+// channel is always buffered (size 1) so this never actually has to drop,
+// but we guard against a nil channel since some callers (e.g. sendNoWait)
+// don't want a result at all.
+func asyncSendErr(ch chan error, err error) {
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- err:
+	default:
+	}
+}
+
+// asyncNotify does a non-blocking send on a size-1 notification channel.
+func asyncNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// min returns the smaller of two uint32s.
+func min(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}